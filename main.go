@@ -1,21 +1,30 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
 	"database/sql"
 	"encoding/csv"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode/utf8"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
@@ -23,16 +32,184 @@ import (
 )
 
 var (
-	db            *sql.DB
-	server        *http.Server
-	csvFile       string
-	csvDelimiter  rune
-	csvFieldCount int
-	csvHasHeader  bool
-	csvHeader     []string
-	csvIndicies   []string
+	// dbMu guards db, roDB, csvColumns and csvColumnKinds, which are all
+	// swapped out together whenever the CSV is reloaded. Handlers take a
+	// read lock for the duration of a request; a reload takes the write
+	// lock only for the instant it takes to swap the pointers in, so it
+	// waits for in-flight requests to finish and blocks new ones from
+	// starting against a half-swapped state.
+	dbMu            sync.RWMutex
+	db              *sql.DB
+	roDB            *sql.DB
+	server          *http.Server
+	csvFileSpecs    fileList
+	csvFiles        []string
+	csvDelimiter    rune
+	csvFieldCount   int
+	csvHasHeader    bool
+	csvHeader       []string
+	csvIndicies     []string
+	csvColumns      []string
+	csvColumnKinds  map[string]columnType
+	csvBatchSize    int
+	csvOnError      string
+	csvSniffRows    int
+	csvColumnTypes  string
+	csvMaxRows      int
+	csvQueryTimeout time.Duration
 )
 
+// fileList is a flag.Value that accumulates every value passed to a
+// repeatable flag, splitting each one on commas, so -file can be given
+// multiple times and/or as a comma-separated list.
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, trySplit(value, ",")...)
+	return nil
+}
+
+// multiCloser closes both of the underlying closers of a decompressed,
+// archive-backed CSV source (e.g. a zip entry and the zip reader it came
+// from), in order.
+type multiCloser struct {
+	inner, outer io.Closer
+}
+
+func (m multiCloser) Close() error {
+	m.inner.Close()
+	return m.outer.Close()
+}
+
+// openCSVSource opens path for reading, transparently decompressing .gz,
+// .bz2 and .zip files so the CSV reader always sees plain CSV bytes. For a
+// .zip archive, only its first entry is read.
+func openCSVSource(path string) (io.Reader, io.Closer, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+
+	case ".gz":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return gzReader, file, nil
+
+	case ".bz2":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bzip2.NewReader(file), file, nil
+
+	case ".zip":
+		zipReader, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(zipReader.File) == 0 {
+			zipReader.Close()
+			return nil, nil, fmt.Errorf("zip archive %s has no files in it", path)
+		}
+		entry, err := zipReader.File[0].Open()
+		if err != nil {
+			zipReader.Close()
+			return nil, nil, err
+		}
+		return entry, multiCloser{inner: entry, outer: zipReader}, nil
+
+	default:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, file, nil
+	}
+}
+
+// columnType is a column's inferred (or overridden) SQLite type.
+type columnType int
+
+const (
+	typeText columnType = iota
+	typeInteger
+	typeReal
+	typeBoolean
+	typeDatetime
+)
+
+// String returns the SQLite type keyword for a column type.
+func (t columnType) String() string {
+	switch t {
+	case typeInteger:
+		return "INTEGER"
+	case typeReal:
+		return "REAL"
+	case typeBoolean:
+		return "BOOLEAN"
+	case typeDatetime:
+		return "DATETIME"
+	default:
+		return "TEXT"
+	}
+}
+
+// columnTypeNames maps the type keywords accepted by -column-types to a columnType.
+var columnTypeNames = map[string]columnType{
+	"text":     typeText,
+	"int":      typeInteger,
+	"integer":  typeInteger,
+	"real":     typeReal,
+	"float":    typeReal,
+	"bool":     typeBoolean,
+	"boolean":  typeBoolean,
+	"datetime": typeDatetime,
+	"date":     typeDatetime,
+}
+
+// datetimeLayouts are the layouts tried, in order, when sniffing or parsing a DATETIME column.
+var datetimeLayouts = []string{
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+}
+
+// queryOperators maps the operator suffix used in a `field__op` URL
+// parameter (e.g. `price__gt=10`) to the SQL operator it compiles to.
+var queryOperators = map[string]string{
+	"gt":   ">",
+	"lt":   "<",
+	"gte":  ">=",
+	"lte":  "<=",
+	"ne":   "!=",
+	"like": "LIKE",
+	"in":   "IN",
+}
+
+// reservedQueryParams are URL parameters that control the shape of the
+// query itself (sorting, pagination, projection, counting) or the response
+// format, rather than filtering rows, so they are never treated as column
+// filters.
+var reservedQueryParams = map[string]bool{
+	"sort":      true,
+	"limit":     true,
+	"offset":    true,
+	"fields":    true,
+	"count":     true,
+	"format":    true,
+	"delimiter": true,
+}
+
 // trySplit attempts to split the given string by calling
 // strings.Split for each separator in the order given.
 // It returns the first successful split that occurs.
@@ -45,6 +222,164 @@ func trySplit(str string, seps ...string) []string {
 	return []string{str}
 }
 
+// sanitizeColumnName strips any character that isn't alphanumeric from a
+// CSV header value and lower-cases it, producing a safe SQLite column name.
+func sanitizeColumnName(name string) string {
+	reg := regexp.MustCompile("[^a-zA-Z0-9]+")
+	return strings.ToLower(reg.ReplaceAllString(name, ""))
+}
+
+// isValidColumn reports whether name is one of the columns created for the
+// csv table, so it's safe to interpolate into a query string.
+func isValidColumn(name string) bool {
+	for _, column := range csvColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseColumnTypeOverrides parses a -column-types flag value such as
+// "price:real,active:bool,ts:datetime" into a map of sanitized column
+// name to the columnType it should be forced to, skipping type sniffing.
+func parseColumnTypeOverrides(spec string) map[string]columnType {
+	overrides := make(map[string]columnType)
+	if spec == "" {
+		return overrides
+	}
+	for _, entry := range trySplit(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("'%s' is not a valid -column-types entry, expected column:type\n", entry)
+		}
+		column := sanitizeColumnName(parts[0])
+		t, ok := columnTypeNames[strings.ToLower(parts[1])]
+		if !ok {
+			log.Fatalf("'%s' is not a recognised column type for column %s\n", parts[1], column)
+		}
+		overrides[column] = t
+	}
+	return overrides
+}
+
+// isDatetime reports whether value matches one of the known datetime layouts.
+func isDatetime(value string) bool {
+	for _, layout := range datetimeLayouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffColumnType inspects a sample of values for a single column and
+// returns the narrowest type that every non-empty value satisfies,
+// falling back to TEXT when nothing more specific fits.
+func sniffColumnType(values []string) columnType {
+	sawValue, allInteger, allReal, allBoolean, allDatetime := false, true, true, true, true
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		sawValue = true
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			allInteger = false
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			allReal = false
+		}
+		if _, err := strconv.ParseBool(value); err != nil {
+			allBoolean = false
+		}
+		if !isDatetime(value) {
+			allDatetime = false
+		}
+	}
+	switch {
+	case !sawValue:
+		return typeText
+	case allInteger:
+		return typeInteger
+	case allReal:
+		return typeReal
+	case allBoolean:
+		return typeBoolean
+	case allDatetime:
+		return typeDatetime
+	default:
+		return typeText
+	}
+}
+
+// convertValue converts a raw CSV field into the Go type that matches its
+// column's inferred or overridden SQLite type. An empty field is treated as
+// NULL for every type except TEXT, where the empty string is preserved.
+func convertValue(raw string, t columnType) (interface{}, error) {
+	if t != typeText && raw == "" {
+		return nil, nil
+	}
+	switch t {
+	case typeInteger:
+		return strconv.ParseInt(raw, 10, 64)
+	case typeReal:
+		return strconv.ParseFloat(raw, 64)
+	case typeBoolean:
+		return strconv.ParseBool(raw)
+	case typeDatetime:
+		for _, layout := range datetimeLayouts {
+			if ts, err := time.Parse(layout, raw); err == nil {
+				return ts, nil
+			}
+		}
+		return nil, fmt.Errorf("'%s' does not match a known datetime layout", raw)
+	default:
+		return raw, nil
+	}
+}
+
+// parseFieldOperator splits a query parameter key such as "price__gt" into
+// its column name and SQL operator. Keys without a recognised "__op" suffix
+// are treated as an exact match on the whole key.
+func parseFieldOperator(key string) (field string, operator string) {
+	if idx := strings.LastIndex(key, "__"); idx != -1 {
+		if op, ok := queryOperators[key[idx+2:]]; ok {
+			return key[:idx], op
+		}
+	}
+	return key, "="
+}
+
+// coerceFilterValue adapts a raw URL query filter value to the form it's
+// actually stored in for field's column type, so a filter compares like with
+// like. This matters for BOOLEAN columns in particular: SQLite has no native
+// boolean storage, so go-sqlite3 persists them as the integers 0/1, and a
+// filter value of the literal string "true" would never match a stored 1.
+// DATETIME values are parsed with the same layouts used on import, so the
+// driver binds them in the same timestamp text it stored. Other column types
+// compare fine as the raw string (SQLite's type affinity coerces it), so they
+// pass through unchanged, as does any value that fails to parse.
+func coerceFilterValue(field, raw string) interface{} {
+	switch csvColumnKinds[field] {
+	case typeBoolean:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return raw
+		}
+		if b {
+			return 1
+		}
+		return 0
+	case typeDatetime:
+		for _, layout := range datetimeLayouts {
+			if ts, err := time.Parse(layout, raw); err == nil {
+				return ts
+			}
+		}
+	}
+	return raw
+}
+
 func parseEnvironment() {
 
 	// Info message
@@ -52,21 +387,41 @@ func parseEnvironment() {
 
 	// Define configuration variables
 	flagSet := flag.NewFlagSetWithEnvPrefix(os.Args[0], "CSV", 0)
-	flagSet.StringVar(&csvFile, "file", "", "path to csv file")
+	flagSet.Var(&csvFileSpecs, "file", "path(s) to csv file(s); may be repeated, comma-separated, or a glob, and may be .gz/.bz2/.zip compressed")
 	delimiter := flagSet.String("delimiter", ",", "data separator in the csv file")
 	flagSet.IntVar(&csvFieldCount, "field-count", 0, "the number of fields/columns in the csv file")
 	flagSet.BoolVar(&csvHasHeader, "has-header", true, "whether or not the csv file has a header")
 	header := flagSet.String("header", "", "a custom header to use")
 	indicies := flagSet.String("indicies", "", "headers to create indicies for")
+	flagSet.IntVar(&csvBatchSize, "batch-size", 10000, "number of rows to import per transaction")
+	flagSet.StringVar(&csvOnError, "on-error", "fail", "what to do with a bad row: skip or fail")
+	flagSet.IntVar(&csvSniffRows, "sniff-rows", 1000, "number of rows to sample when inferring column types")
+	flagSet.StringVar(&csvColumnTypes, "column-types", "", "comma-separated column:type overrides, e.g. price:real,active:bool")
+	flagSet.IntVar(&csvMaxRows, "max-rows", 10000, "maximum number of rows the /sql endpoint will return")
+	queryTimeout := flagSet.Int("query-timeout", 30, "seconds before a /sql query is cancelled")
 
 	// Parse the CLI flags/environment variables
 	flagSet.Parse(os.Args[1:])
 
-	// Check that a CSV file was provided
-	if csvFile == "" {
+	// Check that at least one CSV file was provided, then expand every spec
+	// (a literal path or a glob pattern) into the concrete files it matches
+	if len(csvFileSpecs) == 0 {
 		log.Fatalln("no CSV file specified")
 	}
-	log.Printf("using %s as the input CSV file\n", csvFile)
+	for _, spec := range csvFileSpecs {
+		matches, err := filepath.Glob(spec)
+		if err != nil {
+			log.Fatalf("'%s' is not a valid -file glob: %s\n", spec, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{spec}
+		}
+		csvFiles = append(csvFiles, matches...)
+	}
+	if len(csvFiles) == 0 {
+		log.Fatalln("no CSV file specified")
+	}
+	log.Printf("using %d input file(s) as the input CSV: %+v\n", len(csvFiles), csvFiles)
 
 	// Decode the delimiter into a Rune
 	if csvDelimiter, _ = utf8.DecodeRuneInString(*delimiter); csvDelimiter == utf8.RuneError {
@@ -95,6 +450,33 @@ func parseEnvironment() {
 		log.Printf("using a custom header: %+v", csvHeader)
 	}
 
+	// Check that the batch size and error handling mode are sane
+	if csvBatchSize <= 0 {
+		log.Fatalf("'%d' is not a valid batch size, expected a positive integer\n", csvBatchSize)
+	}
+	log.Printf("committing every %d rows\n", csvBatchSize)
+	if csvOnError != "skip" && csvOnError != "fail" {
+		log.Fatalf("'%s' is not a valid -on-error mode, expected 'skip' or 'fail'\n", csvOnError)
+	}
+	log.Printf("using on-error mode: %s\n", csvOnError)
+
+	// Check that the sniff row count is sane
+	if csvSniffRows < 0 {
+		log.Fatalf("'%d' is not a valid sniff row count, expected a non-negative integer\n", csvSniffRows)
+	}
+	log.Printf("sniffing column types from up to %d rows\n", csvSniffRows)
+
+	// Check that the /sql endpoint limits are sane
+	if csvMaxRows <= 0 {
+		log.Fatalf("'%d' is not a valid max row count, expected a positive integer\n", csvMaxRows)
+	}
+	log.Printf("capping /sql results at %d rows\n", csvMaxRows)
+	if *queryTimeout <= 0 {
+		log.Fatalf("'%d' is not a valid query timeout, expected a positive number of seconds\n", *queryTimeout)
+	}
+	csvQueryTimeout = time.Duration(*queryTimeout) * time.Second
+	log.Printf("cancelling /sql queries after %s\n", csvQueryTimeout)
+
 	// Check if a indicies were provided and attempt to parse the
 	// indicies using either the CSV delimiter or comma delimiter.
 	if *indicies != "" {
@@ -104,135 +486,472 @@ func parseEnvironment() {
 
 }
 
-func processCSV() {
+// processCSV reads csvFiles into a brand new pair of SQLite handles (a
+// read-write one for import and normal queries, a read-only one for the /sql
+// endpoint) and returns them along with the resulting column list, without
+// touching the package-level db/roDB/csvColumns. This lets it be re-run
+// against a freshly-written input file while the previous database is still
+// serving requests; the caller is responsible for swapping the results in.
+// Every failure that used to be fatal on startup is instead returned as an
+// error, since a failed reload must leave the running server untouched.
+func processCSV() (newDB *sql.DB, newRoDB *sql.DB, columns []string, columnKinds map[string]columnType, err error) {
 
 	// Info message
 	log.Println("*** Processing CSV file ***")
 
-	// Open a connection to an in-memory sqlite database
-	var err error
-	db, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	// Open a connection to a uniquely-named in-memory sqlite database, so a
+	// reload never collides with the handles it's about to replace.
+	dbName := fmt.Sprintf("webcsv%d", time.Now().UnixNano())
+	newDB, err = sql.Open("sqlite3", "file:"+dbName+"?mode=memory&cache=shared")
 	if err != nil {
-		log.Fatalf("could not create SQLite database: %s\n", err)
+		return nil, nil, nil, nil, fmt.Errorf("could not create SQLite database: %s", err)
 	}
 
-	// Open the CSV file
-	file, err := os.Open(csvFile)
+	// Open a second handle onto the same shared-cache in-memory database for
+	// the /sql passthrough endpoint. It has to share dbName's "mode=memory"
+	// rather than "mode=ro": combined with a bare name, mode=ro points
+	// SQLite at an on-disk file that was never created, not at this
+	// in-memory database. isSelectOnly is what actually keeps this handle
+	// read-only.
+	newRoDB, err = sql.Open("sqlite3", "file:"+dbName+"?mode=memory&cache=shared")
 	if err != nil {
-		log.Fatalf("could not open CSV file at: %s\n", csvFile)
+		newDB.Close()
+		return nil, nil, nil, nil, fmt.Errorf("could not open read-only SQLite handle: %s", err)
 	}
-	defer file.Close()
 
-	// Create the CSV reader
-	reader := csv.NewReader(bufio.NewReader(file))
-	reader.Comma = csvDelimiter
-	reader.LazyQuotes = true
+	// fail closes the handles opened above and returns a formatted error, so
+	// every error path below can bail out through a single line.
+	fail := func(format string, a ...interface{}) (*sql.DB, *sql.DB, []string, map[string]columnType, error) {
+		newDB.Close()
+		newRoDB.Close()
+		return nil, nil, nil, nil, fmt.Errorf(format, a...)
+	}
 
-	// Read the header from the file if we've been told there's a header.
-	// Don't do anything with it if a custom header was specified.
-	if csvHasHeader {
+	// header and fieldCount start from the -header/-field-count flags (if
+	// given) and are otherwise derived fresh from this call's input files, so
+	// a reload always reflects what's in the files right now rather than
+	// whatever a previous call happened to detect.
+	header := csvHeader
+	fieldCount := csvFieldCount
+
+	// currentReader/currentCloser/currentSource track the file currently
+	// being read; openNextFile advances to the next entry in csvFiles,
+	// transparently decompressing it and consuming its header line.
+	fileIndex := 0
+	var currentReader *csv.Reader
+	var currentCloser io.Closer
+	var currentSource string
+	openNextFile := func() error {
+		if currentCloser != nil {
+			currentCloser.Close()
+		}
+		if fileIndex >= len(csvFiles) {
+			return io.EOF
+		}
+		path := csvFiles[fileIndex]
+		fileIndex++
+		log.Printf("opening input file %d/%d: %s\n", fileIndex, len(csvFiles), path)
 
-		// Read the header
-		line, err := reader.Read()
+		source, closer, err := openCSVSource(path)
 		if err != nil {
-			log.Fatalf("could not read header: %s\n", err)
+			return fmt.Errorf("could not open CSV file at %s: %s", path, err)
+		}
+
+		reader := csv.NewReader(bufio.NewReader(source))
+		reader.Comma = csvDelimiter
+		reader.LazyQuotes = true
+
+		// Read the header from the file if we've been told there's a header.
+		// Don't do anything with it if a custom header was specified.
+		if csvHasHeader {
+			line, err := reader.Read()
+			if err != nil {
+				closer.Close()
+				return fmt.Errorf("could not read header from %s: %s", path, err)
+			}
+			if len(header) == 0 {
+				log.Println("using the first line in the first file as the header")
+				header = line
+			}
+		}
+
+		currentReader = reader
+		currentCloser = closer
+		currentSource = filepath.Base(path)
+		return nil
+	}
+	defer func() {
+		if currentCloser != nil {
+			currentCloser.Close()
 		}
+	}()
 
-		// Use the data header only if a custom header wasn't provided
-		if len(csvHeader) == 0 {
-			log.Println("using the first line in CSV as the header")
-			csvHeader = line
-		} else {
-			log.Println("discarding header in favour of the provided custom header")
+	// nextRow returns the next data row across all input files, transparently
+	// advancing to the next file (and past its header) once the current one
+	// is exhausted. err is io.EOF only once every file has been read.
+	nextRow := func() (line []string, source string, err error) {
+		for {
+			if currentReader == nil {
+				if err := openNextFile(); err != nil {
+					return nil, "", err
+				}
+			}
+			line, err = currentReader.Read()
+			if err == io.EOF {
+				currentReader = nil
+				continue
+			}
+			return line, currentSource, err
 		}
+	}
 
+	// Open the first file so the header (and therefore the field count) is known
+	if err := openNextFile(); err != nil {
+		return fail("could not open input: %s", err)
 	}
 
 	// Determine the field count if it wasn't provided
-	if csvFieldCount == 0 {
-		csvFieldCount = len(csvHeader)
-		log.Printf("using a field count of %d\n", csvFieldCount)
+	if fieldCount == 0 {
+		fieldCount = len(header)
+		log.Printf("using a field count of %d\n", fieldCount)
 	}
 
-	// Build the SQL command to create the table using the header information
-	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-	query := "create table csv ("
-	for i := 0; i < csvFieldCount; i++ {
-		columnName := reg.ReplaceAllString(csvHeader[i], "")
-		query += strings.ToLower(columnName)
-		if i == csvFieldCount-1 {
-			query += " text);"
-		} else {
-			query += " text, "
+	// Sample up to -sniff-rows data rows (across files, if necessary) to infer
+	// each column's type. These rows are buffered rather than discarded:
+	// they're the first rows inserted once the table exists. A row that fails
+	// to read is buffered with its error (and no values, so it doesn't sway
+	// the inferred types) and is then skipped or aborts the import according
+	// to -on-error, like any other bad row.
+	sniffRows := make([][]string, 0, csvSniffRows)
+	sniffSources := make([]string, 0, csvSniffRows)
+	sniffErrs := make([]error, 0, csvSniffRows)
+	for len(sniffRows) < csvSniffRows {
+		line, source, err := nextRow()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			line = nil
+		}
+		sniffRows = append(sniffRows, line)
+		sniffSources = append(sniffSources, source)
+		sniffErrs = append(sniffErrs, err)
+	}
+	log.Printf("sniffing column types from %d sampled rows\n", len(sniffRows))
+
+	// Apply any -column-types overrides, falling back to sniffing for the rest
+	overrides := parseColumnTypeOverrides(csvColumnTypes)
+	columnTypes := make([]columnType, fieldCount)
+	for i := 0; i < fieldCount; i++ {
+		columnName := sanitizeColumnName(header[i])
+		if t, ok := overrides[columnName]; ok {
+			columnTypes[i] = t
+			continue
 		}
+		values := make([]string, 0, len(sniffRows))
+		for _, row := range sniffRows {
+			if i < len(row) {
+				values = append(values, row[i])
+			}
+		}
+		columnTypes[i] = sniffColumnType(values)
+	}
+
+	// Build the SQL command to create the table using the header information,
+	// the type inferred (or overridden) for each column, and a trailing
+	// _source column recording which input file produced each row.
+	query := "create table csv ("
+	columnKinds = make(map[string]columnType, fieldCount)
+	for i := 0; i < fieldCount; i++ {
+		columnName := sanitizeColumnName(header[i])
+		columns = append(columns, columnName)
+		columnKinds[columnName] = columnTypes[i]
+		query += columnName + " " + columnTypes[i].String() + ", "
 	}
+	columns = append(columns, "_source")
+	query += "_source text);"
+	log.Printf("inferred column types: %+v", columnTypes)
 
 	// Execute the query
 	log.Printf("creating SQLite table: %s\n", query)
-	_, err = db.Exec(query)
-	if err != nil {
-		log.Fatalf("could not create SQLite table: %s\n", err)
+	if _, err := newDB.Exec(query); err != nil {
+		return fail("could not create SQLite table: %s", err)
 	}
 
 	// Create indicies
 	for _, index := range csvIndicies {
 		query := "create index " + index + "_idx on csv (" + index + ")"
 		log.Printf("creating index: %s\n", query)
-		_, err = db.Exec(query)
+		if _, err := newDB.Exec(query); err != nil {
+			return fail("could not create index on %s: %s", index, err)
+		}
+	}
+
+	// Build the prepared insert statement once; it's reused for every row
+	// across every batch instead of building a fresh query string per row.
+	placeholders := make([]string, fieldCount+1)
+	for i := range placeholders {
+		placeholders[i] = "?"
+	}
+	insertQuery := "insert into csv values (" + strings.Join(placeholders, ",") + ");"
+
+	// beginBatch opens a new transaction and prepares the insert statement
+	// against it; each batch of rows is committed as a unit.
+	beginBatch := func() (*sql.Tx, *sql.Stmt, error) {
+		tx, err := newDB.Begin()
 		if err != nil {
-			log.Fatalf("could not create index on %s: %s\n", index, err)
+			return nil, nil, fmt.Errorf("could not begin transaction: %s", err)
 		}
+		stmt, err := tx.Prepare(insertQuery)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not prepare insert statement: %s", err)
+		}
+		return tx, stmt, nil
+	}
+
+	// nextLine drains the already-buffered sniff rows before reading any
+	// further rows from the input files, so nothing sampled for type
+	// inference is lost.
+	sniffIndex := 0
+	nextLine := func() (line []string, source string, err error) {
+		if sniffIndex < len(sniffRows) {
+			line, source, err = sniffRows[sniffIndex], sniffSources[sniffIndex], sniffErrs[sniffIndex]
+			sniffIndex++
+			return line, source, err
+		}
+		return nextRow()
 	}
 
 	// Read the CSV data
 	log.Println("importing CSV data into SQLite..")
 	rows := 0
+	lineNumber := 0
+	if csvHasHeader {
+		lineNumber++
+	}
+	tx, stmt, err := beginBatch()
+	if err != nil {
+		return fail("%s", err)
+	}
+rowLoop:
 	for {
 
-		// Read the next line, quit when we are done or if we encounter an error
-		line, err := reader.Read()
+		// Read the next line, quit when we are done
+		lineNumber++
+		line, source, err := nextLine()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatalln(err)
+			log.Printf("could not read line %d: %s\n", lineNumber, err)
+			if csvOnError == "skip" {
+				continue
+			}
+			return fail("aborting import at line %d: %s", lineNumber, err)
 		}
 
-		// Build the SQL command to insert the data
-		query := "insert into csv values ("
-		var args []interface{}
-		for i := 0; i < csvFieldCount; i++ {
-			if i == csvFieldCount-1 {
-				query += "?);"
-			} else {
-				query += "?,"
+		// Convert every field to the Go type that matches its column's type.
+		// A row shorter than fieldCount (e.g. a file with fewer columns than
+		// another input file) is treated as a conversion error rather than
+		// indexed into directly, the same way the sniff loop above guards
+		// against it with "if i < len(row)".
+		args := make([]interface{}, fieldCount+1)
+		for i := 0; i < fieldCount; i++ {
+			if i >= len(line) {
+				err := fmt.Errorf("row has only %d field(s), expected %d", len(line), fieldCount)
+				log.Printf("could not convert line %d, column %s: %s\n", lineNumber, columns[i], err)
+				if csvOnError == "skip" {
+					continue rowLoop
+				}
+				return fail("aborting import at line %d: %s", lineNumber, err)
 			}
-			args = append(args, line[i])
+			value, err := convertValue(line[i], columnTypes[i])
+			if err != nil {
+				log.Printf("could not convert line %d, column %s: %s\n", lineNumber, columns[i], err)
+				if csvOnError == "skip" {
+					continue rowLoop
+				}
+				return fail("aborting import at line %d: %s", lineNumber, err)
+			}
+			args[i] = value
 		}
+		args[fieldCount] = source
 
-		// Execute the query
-		_, err = db.Exec(query, args...)
-		if err != nil {
-			log.Fatalf("could not import data into SQLite: %s; command: %s\n", err, query)
+		// Execute the prepared insert for this row
+		if _, err := stmt.Exec(args...); err != nil {
+			log.Printf("could not import line %d: %s; command: %s\n", lineNumber, err, insertQuery)
+			if csvOnError == "skip" {
+				continue
+			}
+			return fail("aborting import at line %d: %s", lineNumber, err)
 		}
 		rows++
 
+		// Commit every csvBatchSize rows and start a fresh transaction
+		if rows%csvBatchSize == 0 {
+			log.Printf("imported %d rows so far..\n", rows)
+			stmt.Close()
+			if err := tx.Commit(); err != nil {
+				return fail("could not commit transaction: %s", err)
+			}
+			tx, stmt, err = beginBatch()
+			if err != nil {
+				return fail("%s", err)
+			}
+		}
+
+	}
+
+	// Commit whatever rows are left in the final, partial batch
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return fail("could not commit final transaction: %s", err)
 	}
+
 	log.Printf("successfully imported %d rows into SQLite\n", rows)
 
+	return newDB, newRoDB, columns, columnKinds, nil
 }
 
-func handleRequest(c *gin.Context) {
+// buildQuery parses URL query parameters into a parameterized SELECT
+// statement against the csv table, shared by the JSON and CSV response
+// handlers. It supports operator filters (field__gt, field__in, etc.),
+// ?sort=, ?limit=/?offset=, ?fields= projection and ?count=true. On invalid
+// input it writes the 400 response itself and returns ok=false.
+func buildQuery(c *gin.Context, params url.Values) (query string, args []interface{}, countMode bool, ok bool) {
+
+	// Column projection via ?fields=a,b,c
+	columns := "*"
+	if fields := params.Get("fields"); fields != "" {
+		requested := trySplit(fields, ",")
+		for _, field := range requested {
+			if !isValidColumn(field) {
+				c.JSON(400, "unknown field: "+field)
+				return "", nil, false, false
+			}
+		}
+		columns = strings.Join(requested, ", ")
+	}
 
-	// Build the query
-	query := "SELECT * FROM csv WHERE "
-	var args []interface{}
-	for key, values := range c.Request.URL.Query() {
+	// Build the WHERE clause from every non-reserved query parameter,
+	// supporting operator suffixes such as field__gt, field__in, etc.
+	var conditions []string
+	for key, values := range params {
+		if reservedQueryParams[key] {
+			continue
+		}
+		field, operator := parseFieldOperator(key)
+		if !isValidColumn(field) {
+			c.JSON(400, "unknown field: "+field)
+			return "", nil, false, false
+		}
 		for _, value := range values {
-			query += key + "=? AND "
-			args = append(args, value)
+			if operator == "IN" {
+				items := trySplit(value, ",")
+				placeholders := make([]string, len(items))
+				for i, item := range items {
+					placeholders[i] = "?"
+					args = append(args, coerceFilterValue(field, item))
+				}
+				conditions = append(conditions, field+" IN ("+strings.Join(placeholders, ",")+")")
+			} else {
+				conditions = append(conditions, field+" "+operator+" ?")
+				args = append(args, coerceFilterValue(field, value))
+			}
+		}
+	}
+
+	// ?count=true short-circuits into a row count instead of the rows themselves
+	countMode = params.Get("count") == "true"
+	selectClause := "SELECT " + columns
+	if countMode {
+		selectClause = "SELECT COUNT(*)"
+	}
+
+	query = selectClause + " FROM csv"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	if sort := params.Get("sort"); sort != "" && !countMode {
+		var order []string
+		for _, field := range trySplit(sort, ",") {
+			direction := "ASC"
+			if strings.HasPrefix(field, "-") {
+				direction = "DESC"
+				field = field[1:]
+			}
+			if !isValidColumn(field) {
+				c.JSON(400, "unknown field: "+field)
+				return "", nil, false, false
+			}
+			order = append(order, field+" "+direction)
 		}
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+
+	if !countMode {
+		hasLimit := false
+		if limit := params.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				c.JSON(400, "invalid limit: "+limit)
+				return "", nil, false, false
+			}
+			query += " LIMIT " + strconv.Itoa(n)
+			hasLimit = true
+		}
+		if offset := params.Get("offset"); offset != "" {
+			n, err := strconv.Atoi(offset)
+			if err != nil {
+				c.JSON(400, "invalid offset: "+offset)
+				return "", nil, false, false
+			}
+			// SQLite requires a LIMIT before an OFFSET, so synthesize an
+			// unbounded one when the caller gave an offset alone.
+			if !hasLimit {
+				query += " LIMIT -1"
+			}
+			query += " OFFSET " + strconv.Itoa(n)
+		}
+	}
+
+	return query, args, countMode, true
+}
+
+func handleRequest(c *gin.Context) {
+
+	// Hold db/roDB/csvColumns steady against a concurrent reload for the
+	// whole request; a reload's write lock waits for this to release.
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	params := c.Request.URL.Query()
+	query, args, countMode, ok := buildQuery(c, params)
+	if !ok {
+		return
+	}
+
+	// ?format=csv hands the same query off to the CSV writer instead of
+	// returning JSON, mirroring what GET /csv does.
+	if params.Get("format") == "csv" {
+		delimiter, ok := parseExportDelimiter(c, params)
+		if !ok {
+			return
+		}
+		writeCSVResponse(c, query, args, delimiter)
+		return
+	}
+
+	// ?count=true only needs the row count, not a result set
+	if countMode {
+		var count int
+		if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+			log.Printf("could not count rows: %s; command: %s\n", err, query)
+			c.JSON(400, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"count": count})
+		return
 	}
-	query = query[0 : len(query)-5]
 
 	// Execute the query
 	rows, err := db.Query(query, args...)
@@ -245,14 +964,14 @@ func handleRequest(c *gin.Context) {
 
 	// Convert the results into a JSON array
 	data := []map[string]interface{}{}
-	columns, _ := rows.Columns()
+	resultColumns, _ := rows.Columns()
 	for rows.Next() {
 
 		// Create a slice to hold the resulting data and a second slice
 		// of pointers to each element in the former slice.
-		values := make([]string, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-		for i := range columns {
+		values := make([]interface{}, len(resultColumns))
+		valuePtrs := make([]interface{}, len(resultColumns))
+		for i := range resultColumns {
 			valuePtrs[i] = &values[i]
 		}
 
@@ -263,13 +982,14 @@ func handleRequest(c *gin.Context) {
 			return
 		}
 
-		// Store the results into a map, using the column name as the key. We also
-		// attempt to convert the value into a float64 (number) when possible.
+		// Store the results into a map, using the column name as the key. The
+		// driver already returns int64/float64/bool/time.Time for columns
+		// created with those types, so no further coercion is needed; only
+		// []byte needs converting back into a string.
 		m := make(map[string]interface{})
-		for i, column := range columns {
-			value := strings.Replace(values[i], ",", "", -1)
-			if number, err := strconv.ParseFloat(value, 64); err == nil {
-				m[column] = number
+		for i, column := range resultColumns {
+			if raw, ok := values[i].([]byte); ok {
+				m[column] = string(raw)
 			} else {
 				m[column] = values[i]
 			}
@@ -292,6 +1012,224 @@ func handleRequest(c *gin.Context) {
 
 }
 
+// handleCSVRequest runs the same query as handleRequest but streams the
+// results back as a CSV file instead of JSON.
+func handleCSVRequest(c *gin.Context) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	params := c.Request.URL.Query()
+	query, args, _, ok := buildQuery(c, params)
+	if !ok {
+		return
+	}
+	delimiter, ok := parseExportDelimiter(c, params)
+	if !ok {
+		return
+	}
+	writeCSVResponse(c, query, args, delimiter)
+}
+
+// parseExportDelimiter reads the ?delimiter= override for a CSV export,
+// defaulting to a comma. It writes the 400 response itself on an invalid value.
+func parseExportDelimiter(c *gin.Context, params url.Values) (rune, bool) {
+	delimiter := ','
+	if d := params.Get("delimiter"); d != "" {
+		r, _ := utf8.DecodeRuneInString(d)
+		if r == utf8.RuneError {
+			c.JSON(400, "invalid delimiter: "+d)
+			return 0, false
+		}
+		delimiter = r
+	}
+	return delimiter, true
+}
+
+// formatCSVValue renders a scanned column value as the string that belongs
+// in a CSV cell.
+func formatCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// writeCSVResponse executes query and streams its results to c as a CSV
+// file, flushing periodically so large result sets don't buffer entirely in memory.
+func writeCSVResponse(c *gin.Context, query string, args []interface{}, delimiter rune) {
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("could not query for data: %s; command: %s\n", err, query)
+		c.JSON(400, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	resultColumns, err := rows.Columns()
+	if err != nil {
+		log.Printf("could not read result columns: %s\n", err)
+		c.JSON(500, err.Error())
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=export.csv")
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Comma = delimiter
+	if err := writer.Write(resultColumns); err != nil {
+		log.Printf("could not write CSV header: %s\n", err)
+		return
+	}
+
+	const flushEvery = 1000
+	values := make([]interface{}, len(resultColumns))
+	valuePtrs := make([]interface{}, len(resultColumns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	rowCount := 0
+	for rows.Next() {
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			log.Printf("could not read row: %s\n", err)
+			break
+		}
+
+		record := make([]string, len(values))
+		for i, value := range values {
+			record[i] = formatCSVValue(value)
+		}
+		if err := writer.Write(record); err != nil {
+			log.Printf("could not write CSV row: %s\n", err)
+			break
+		}
+
+		rowCount++
+		if rowCount%flushEvery == 0 {
+			writer.Flush()
+		}
+
+	}
+	writer.Flush()
+
+	if err := rows.Err(); err != nil {
+		log.Printf("error iterating through the results: %s\n", err)
+	}
+
+}
+
+// isSelectOnly reports whether query's first keyword is SELECT or WITH, the
+// only statements the /sql endpoint is allowed to run.
+func isSelectOnly(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH":
+		return true
+	default:
+		return false
+	}
+}
+
+// capRows wraps a user-supplied SELECT/WITH statement in an outer query that
+// limits it to at most maxRows rows, regardless of what the statement itself asks for.
+func capRows(query string, maxRows int) (string, []interface{}) {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return "SELECT * FROM (" + query + ") LIMIT ?", []interface{}{maxRows}
+}
+
+// handleSQLQuery lets clients run arbitrary read-only SQL against the
+// imported data, via the ?q= parameter on GET or the request body on POST.
+// It runs against roDB, a second handle onto the same in-memory database,
+// and rejects anything that isn't a SELECT/WITH statement as the actual
+// read-only guard.
+func handleSQLQuery(c *gin.Context) {
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	query := c.Query("q")
+	if c.Request.Method == http.MethodPost {
+		if body, err := io.ReadAll(c.Request.Body); err == nil && len(body) > 0 {
+			query = string(body)
+		}
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		c.JSON(400, "no SQL statement provided")
+		return
+	}
+	if !isSelectOnly(query) {
+		c.JSON(400, "only SELECT and WITH statements are allowed")
+		return
+	}
+
+	query, args := capRows(query, csvMaxRows)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), csvQueryTimeout)
+	defer cancel()
+
+	rows, err := roDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("could not execute SQL query: %s; command: %s\n", err, query)
+		c.JSON(400, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	// Convert the results into a JSON array, in the same shape as handleRequest
+	data := []map[string]interface{}{}
+	resultColumns, _ := rows.Columns()
+	for rows.Next() {
+
+		values := make([]interface{}, len(resultColumns))
+		valuePtrs := make([]interface{}, len(resultColumns))
+		for i := range resultColumns {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			log.Printf("could not read row: %s\n", err)
+			c.JSON(500, err.Error())
+			return
+		}
+
+		m := make(map[string]interface{})
+		for i, column := range resultColumns {
+			if raw, ok := values[i].([]byte); ok {
+				m[column] = string(raw)
+			} else {
+				m[column] = values[i]
+			}
+		}
+
+		data = append(data, m)
+
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("error iterating through the results: %s\n", err)
+		c.JSON(500, err.Error())
+		return
+	}
+
+	c.IndentedJSON(200, data)
+
+}
+
 func serveJSON() {
 
 	// Info message
@@ -304,6 +1242,9 @@ func serveJSON() {
 
 	// Request handler
 	router.GET("/", handleRequest)
+	router.GET("/csv", handleCSVRequest)
+	router.GET("/sql", handleSQLQuery)
+	router.POST("/sql", handleSQLQuery)
 
 	// Create the HTTP server
 	server = &http.Server{
@@ -320,6 +1261,105 @@ func serveJSON() {
 
 }
 
+// reloadCSV re-runs processCSV against the current input files and, on
+// success, swaps the resulting db/roDB/csvColumns/csvColumnKinds in for the
+// previous ones. A failed reload is logged and leaves the currently-serving
+// database untouched, so a bad or half-written export can never take the
+// service down. It's triggered by a SIGHUP or a detected change to an input
+// file.
+func reloadCSV() {
+
+	log.Println("*** Reloading CSV file ***")
+
+	newDB, newRoDB, columns, columnKinds, err := processCSV()
+	if err != nil {
+		log.Printf("reload failed, keeping the previous data: %s\n", err)
+		return
+	}
+
+	// Taking the write lock waits for every in-flight request (each holding
+	// a read lock) to finish, so by the time we hold it the old handles have
+	// no readers left and are safe to close.
+	dbMu.Lock()
+	oldDB, oldRoDB := db, roDB
+	db, roDB, csvColumns, csvColumnKinds = newDB, newRoDB, columns, columnKinds
+	dbMu.Unlock()
+
+	if err := oldDB.Close(); err != nil {
+		log.Printf("could not close previous database: %s\n", err)
+	}
+	if err := oldRoDB.Close(); err != nil {
+		log.Printf("could not close previous read-only database: %s\n", err)
+	}
+
+	log.Println("reload complete")
+
+}
+
+// watchCSVFiles watches the directories containing the input files and
+// triggers a debounced reloadCSV whenever one of them is written, created or
+// renamed into place. It watches the containing directories rather than the
+// files themselves because a periodically-regenerated export is typically
+// written to a temporary path and renamed over the original, which would
+// silently break a watch held on the original file's inode.
+func watchCSVFiles() {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("could not start file watcher, hot-reload via fsnotify is disabled: %s\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	watchedDirs := make(map[string]bool)
+	for _, path := range csvFiles {
+		dir := filepath.Dir(path)
+		if watchedDirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("could not watch %s for changes: %s\n", dir, err)
+			continue
+		}
+		watchedDirs[dir] = true
+	}
+
+	isWatchedFile := func(name string) bool {
+		for _, path := range csvFiles {
+			if filepath.Base(path) == filepath.Base(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	const debounce = 500 * time.Millisecond
+	var timer *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 || !isWatchedFile(event.Name) {
+				continue
+			}
+			log.Printf("detected change to %s, scheduling a reload\n", event.Name)
+			if timer == nil {
+				timer = time.AfterFunc(debounce, reloadCSV)
+			} else {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("file watcher error: %s\n", err)
+		}
+	}
+
+}
+
 func shutdown() {
 
 	// Info message
@@ -333,11 +1373,16 @@ func shutdown() {
 		log.Printf("could not stop HTTP server: %s\n", err)
 	}
 
-	// Close the database
+	// Close the databases
 	log.Println("closing SQLite database..")
+	dbMu.Lock()
+	defer dbMu.Unlock()
 	if err := db.Close(); err != nil {
 		log.Printf("could not close database: %s\n", err)
 	}
+	if err := roDB.Close(); err != nil {
+		log.Printf("could not close read-only database: %s\n", err)
+	}
 
 }
 
@@ -347,17 +1392,33 @@ func main() {
 	parseEnvironment()
 
 	// Convert the input CSV file into a SQLite database
-	processCSV()
+	newDB, newRoDB, columns, columnKinds, err := processCSV()
+	if err != nil {
+		log.Fatalf("could not process CSV: %s\n", err)
+	}
+	db, roDB, csvColumns, csvColumnKinds = newDB, newRoDB, columns, columnKinds
 
 	// Serve the SQLite database over HTTP
 	serveJSON()
 
-	// Wait for interrupt signal to gracefully exit
-	interrupt := make(chan os.Signal)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
+	// Watch the input file(s) for changes so a periodically-regenerated
+	// export is picked up without restarting the process
+	go watchCSVFiles()
 
-	// Gracefully shutdown when an interrupt is received
-	shutdown()
+	// Wait for an interrupt or a SIGHUP: a SIGHUP triggers a reload and goes
+	// on serving, an interrupt triggers a graceful shutdown
+	interrupt := make(chan os.Signal, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hup:
+			reloadCSV()
+		case <-interrupt:
+			shutdown()
+			return
+		}
+	}
 
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestHandleSQLQuery imports a small CSV via processCSV and issues a real
+// /sql query against the result, guarding against regressions where roDB's
+// DSN pointed at a database it couldn't actually reach and every query
+// failed at execution time despite the server starting up cleanly.
+func TestHandleSQLQuery(t *testing.T) {
+
+	file, err := os.CreateTemp("", "webcsv-sql-*.csv")
+	if err != nil {
+		t.Fatalf("could not create temp CSV file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("id,name\n1,alice\n2,bob\n"); err != nil {
+		t.Fatalf("could not write temp CSV file: %s", err)
+	}
+	file.Close()
+
+	csvFiles = []string{file.Name()}
+	csvDelimiter = ','
+	csvHasHeader = true
+	csvHeader = nil
+	csvFieldCount = 0
+	csvIndicies = nil
+	csvSniffRows = 1000
+	csvBatchSize = 10000
+	csvOnError = "fail"
+	csvColumnTypes = ""
+	csvMaxRows = 10000
+	csvQueryTimeout = 30 * time.Second
+
+	newDB, newRoDB, columns, columnKinds, err := processCSV()
+	if err != nil {
+		t.Fatalf("processCSV failed: %s", err)
+	}
+	defer newDB.Close()
+	defer newRoDB.Close()
+	db, roDB, csvColumns, csvColumnKinds = newDB, newRoDB, columns, columnKinds
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/sql", handleSQLQuery)
+
+	req := httptest.NewRequest(http.MethodGet, "/sql?q="+url.QueryEscape("SELECT name FROM csv WHERE id=1"), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if !strings.Contains(resp.Body.String(), "alice") {
+		t.Fatalf("expected response to contain 'alice', got: %s", resp.Body.String())
+	}
+
+}